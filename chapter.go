@@ -1,135 +1,163 @@
 package main
 
 import (
-	"encoding/json"
+	"archive/zip"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/awused/manga-syncer/sources"
 )
 
 type chapterJob struct {
-	chapter     mangaChapter
+	source      sources.Source
+	chapter     sources.Chapter
 	archivePath string
+	manga       sources.Manga
 }
 
-type atHomeResponse struct {
-	BaseURL string `json:"baseUrl"`
-}
-
-const atHomeServerURL = "https://api.mangadex.org/at-home/server/%s"
-
-// This one has a hard 1/s limit, so only consume half of it
-var atHomeTicker = time.NewTicker(time.Second * 2)
-
-func downloadImage(url string, file string) error {
-	f, err := os.Create(file)
-	if err != nil {
-		return err
+// downloadImage fetches url into file unless file already exists on disk at
+// the size src reports for url, in which case the existing copy is reused.
+// This lets an interrupted chapter resume without redownloading every page.
+func downloadImage(src sources.Source, url string, file string, rate *byteRate) error {
+	if size, ok := src.FetchSize(url); ok {
+		if fi, err := os.Stat(file); err == nil && fi.Size() == size {
+			return nil
+		}
 	}
-	defer f.Close()
 
-	resp, err := client.Get(url)
+	body, err := src.FetchBytes(url)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return errors.New(resp.Status)
+	if rate != nil {
+		rate.add(len(body))
 	}
 
-	_, err = io.Copy(f, resp.Body)
-	if err != nil {
-		return err
-	}
-	return nil
+	return ioutil.WriteFile(file, body, 0644)
 }
 
-func downloadChapter(c chapterJob) {
-	log.Debugln("Started downloading: " + c.archivePath)
+// chapterWorkDir returns the stable, resumable working directory for a
+// chapter, named after its ID so that re-running the sync finds the same
+// directory rather than leaving orphaned ioutil.TempDir directories behind
+// on every interrupted attempt.
+func chapterWorkDir(c sources.Chapter) string {
+	return filepath.Join(conf.TempDirectory, convertName(c.ID))
+}
 
-	dir, err := ioutil.TempDir(conf.TempDirectory, "manga-syncer")
-	if err != nil {
-		log.Errorln(err)
-		return
+// partialMarkerPath returns the path to the marker file that records which
+// page URLs a chapter's working directory was populated from. It's a
+// sibling of the working directory, not inside it, so it's never mistaken
+// for a downloaded page.
+func partialMarkerPath(dir string) string {
+	return dir + ".partial"
+}
+
+func partialMarkerContent(pages []sources.Page) string {
+	urls := make([]string, len(pages))
+	for i, p := range pages {
+		urls[i] = p.URL
 	}
-	defer os.RemoveAll(dir)
+	return strings.Join(urls, "\n")
+}
 
-	if *chapterFlag == "" {
-		select {
-		case <-closeChan:
-			return
-		case <-atHomeTicker.C:
+// resumeKey returns the identity prepareWorkDir should compare against the
+// marker left by a previous attempt. Sources implementing
+// sources.ResumeKeyer (MangaDex) may hand back page URLs that change on
+// every call even though the pages themselves haven't, so their stable key
+// is preferred over the raw URLs; other sources fall back to the URLs.
+func resumeKey(src sources.Source, c sources.Chapter, pages []sources.Page) string {
+	if rk, ok := src.(sources.ResumeKeyer); ok {
+		if key, err := rk.ResumeKey(c); err == nil {
+			return key
 		}
 	}
+	return partialMarkerContent(pages)
+}
 
-	resp, err := client.Get(fmt.Sprintf(atHomeServerURL, c.chapter.Data.ID))
-	if err != nil {
-		log.Errorln(err)
-		return
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Errorln(err)
-		return
+// prepareWorkDir returns the chapter's stable working directory, wiping and
+// recreating it if its previous contents were downloaded for a different
+// set of pages (e.g. MangaDex reissued a new at-home Hash). Otherwise any
+// pages already on disk from an earlier, interrupted attempt are kept.
+func prepareWorkDir(dir string, content string) error {
+	marker := partialMarkerPath(dir)
+
+	if existing, err := ioutil.ReadFile(marker); err != nil || string(existing) != content {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		log.Errorln("Chapter "+c.chapter.Data.ID, resp.Request.URL, errors.New(resp.Status), string(body))
-		return
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
 
-	var ah atHomeResponse
-	err = json.Unmarshal(body, &ah)
+	return ioutil.WriteFile(marker, []byte(content), 0644)
+}
+
+func downloadChapter(c chapterJob) {
+	log.Debugln("Started downloading: " + c.archivePath)
+
+	dir := chapterWorkDir(c.chapter)
+
+	pages, err := c.source.FetchChapterPages(c.chapter)
 	if err != nil {
-		log.Errorln(err)
+		log.Errorln("Chapter "+c.chapter.ID, err)
 		return
 	}
 
-	if ah.BaseURL == "" {
-		log.Errorln("Chapter "+c.chapter.Data.ID, resp.Request.URL, "Empty base URL")
+	if err := prepareWorkDir(dir, resumeKey(c.source, c.chapter, pages)); err != nil {
+		log.Errorln("Chapter "+c.chapter.ID, "Error preparing working directory", err)
 		return
 	}
 
+	bar, rate := newChapterBar(filepath.Base(c.archivePath), len(pages))
+	finished := false
+	defer func() {
+		if bar != nil && !finished {
+			bar.Abort(true)
+		}
+	}()
+
 	errCh := make(chan error)
-	for i, p := range c.chapter.Data.Attributes.Data {
+	for i, p := range pages {
 		select {
 		case <-closeChan:
 			return
-			// case <-time.After(delay):
 		default:
 		}
 
-		url := ah.BaseURL + "/data/" + c.chapter.Data.Attributes.Hash + "/" + p
-		file := filepath.Join(dir, fmt.Sprintf("%03d", i+1)+filepath.Ext(p))
+		file := filepath.Join(dir, fmt.Sprintf("%03d", i+1)+filepath.Ext(p.URL))
+		url := p.URL
 		go func() {
 			select {
 			case <-closeChan:
 				errCh <- errors.New("closed")
 				return
-				// case <-time.After(delay):
 			case sem <- struct{}{}:
 				defer func() { <-sem }()
 			}
 
-			err := downloadImage(url, file)
+			err := downloadImage(c.source, url, file, rate)
 			if err != nil {
-				log.Errorln("Chapter "+c.chapter.Data.ID, url, err)
+				log.Errorln("Chapter "+c.chapter.ID, url, err)
+			} else if bar != nil {
+				bar.Increment()
 			}
 			errCh <- err
 		}()
 	}
 
-	for range c.chapter.Data.Attributes.Data {
+	for range pages {
 		pageErr := <-errCh
 		if pageErr != nil {
 			err = pageErr
@@ -140,16 +168,74 @@ func downloadChapter(c chapterJob) {
 		return
 	}
 
-	out, err := exec.Command("zip", "-j", "-r", c.archivePath, dir).CombinedOutput()
+	err = writeCBZ(c, dir, len(pages))
 	if err != nil {
-		log.Println("Error zipping directory: " + string(out))
-		log.Errorln(err)
+		log.Errorln("Error writing archive "+c.archivePath, err)
 		return
 	}
 
+	os.RemoveAll(dir)
+	os.Remove(partialMarkerPath(dir))
+
+	finished = true
 	log.Debugln("Finished downloading: " + c.archivePath)
 }
 
+// writeCBZ packages the downloaded pages in dir into a CBZ archive at
+// c.archivePath, optionally embedding a ComicInfo.xml generated from the
+// chapter's metadata.
+func writeCBZ(c chapterJob, dir string, pageCount int) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	out, err := os.Create(c.archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	defer func() {
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for _, f := range files {
+		if err := addFileToZip(zw, filepath.Join(dir, f.Name()), f.Name()); err != nil {
+			return err
+		}
+	}
+
+	if writeComicInfo() {
+		ci := buildComicInfo(c.manga, c.chapter, pageCount)
+		if err := writeComicInfoXML(zw, ci); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addFileToZip(zw *zip.Writer, path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
 func chapterWorker(ch <-chan chapterJob, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -161,5 +247,6 @@ func chapterWorker(ch <-chan chapterJob, wg *sync.WaitGroup) {
 		}
 
 		downloadChapter(c)
+		completeChapterForProgress()
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"strings"
+
+	"github.com/awused/manga-syncer/sources"
+)
+
+// comicInfo mirrors the subset of the ComicInfo.xml schema
+// (https://anansi-project.github.io/docs/comicinfo/documentation) that can
+// be populated from source metadata.
+type comicInfo struct {
+	XMLName         xml.Name `xml:"ComicInfo"`
+	Series          string   `xml:"Series,omitempty"`
+	Number          string   `xml:"Number,omitempty"`
+	Volume          string   `xml:"Volume,omitempty"`
+	Title           string   `xml:"Title,omitempty"`
+	Writer          string   `xml:"Writer,omitempty"`
+	Translator      string   `xml:"Translator,omitempty"`
+	ScanInformation string   `xml:"ScanInformation,omitempty"`
+	LanguageISO     string   `xml:"LanguageISO,omitempty"`
+	Year            int      `xml:"Year,omitempty"`
+	Month           int      `xml:"Month,omitempty"`
+	Day             int      `xml:"Day,omitempty"`
+	PageCount       int      `xml:"PageCount,omitempty"`
+	Web             string   `xml:"Web,omitempty"`
+	Genre           string   `xml:"Genre,omitempty"`
+	Tags            string   `xml:"Tags,omitempty"`
+	AgeRating       string   `xml:"AgeRating,omitempty"`
+}
+
+// ageRating maps a Manga's ContentRating onto the closest value from
+// ComicInfo.xml's AgeRating enum. Sources that don't have an equivalent
+// concept leave ContentRating empty, which maps to "Unknown" here.
+func ageRating(contentRating string) string {
+	switch contentRating {
+	case "safe":
+		return "Everyone"
+	case "suggestive":
+		return "Teen"
+	case "erotica":
+		return "Mature 17+"
+	case "pornographic":
+		return "Adults Only 18+"
+	default:
+		return "Unknown"
+	}
+}
+
+// buildComicInfo populates a comicInfo from the already-fetched manga and
+// chapter metadata.
+func buildComicInfo(m sources.Manga, c sources.Chapter, pageCount int) comicInfo {
+	ci := comicInfo{
+		Series:      m.Title,
+		Number:      c.Number,
+		Volume:      c.Volume,
+		Title:       c.Title,
+		LanguageISO: c.Language,
+		PageCount:   pageCount,
+		Web:         c.URL,
+		AgeRating:   ageRating(m.ContentRating),
+	}
+
+	if !c.PublishedAt.IsZero() {
+		ci.Year = c.PublishedAt.Year()
+		ci.Month = int(c.PublishedAt.Month())
+		ci.Day = c.PublishedAt.Day()
+	}
+
+	if len(c.GroupNames) > 0 {
+		scanlators := strings.Join(c.GroupNames, ", ")
+		ci.Writer = scanlators
+		ci.Translator = scanlators
+		ci.ScanInformation = scanlators
+	}
+
+	if len(m.Tags) > 0 {
+		tags := strings.Join(m.Tags, ", ")
+		ci.Genre = tags
+		ci.Tags = tags
+	}
+
+	return ci
+}
+
+// writeComicInfoXML writes a ComicInfo.xml entry into the given zip archive.
+func writeComicInfoXML(zw *zip.Writer, ci comicInfo) error {
+	w, err := zw.Create("ComicInfo.xml")
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(ci)
+}
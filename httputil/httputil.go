@@ -0,0 +1,376 @@
+// Package httputil provides a shared, retrying, cache-aware HTTP GET used by
+// every source implementation so that retry/backoff and on-disk caching
+// behavior is consistent across providers.
+package httputil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Bounded retry parameters for Fetcher.DoRequest/doRequestWithHeaders.
+const (
+	maxAttempts = 5
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// Fetcher performs retrying HTTP GETs with bounded exponential backoff and
+// an optional on-disk response cache. Each source owns its own Fetcher so
+// that rate limits, caching and interruption are all scoped per-source.
+type Fetcher struct {
+	Client    *http.Client
+	Interrupt <-chan struct{}
+
+	// CacheName namespaces this fetcher's on-disk cache directory, e.g. the
+	// source's name, so that different sources never collide on cache keys.
+	CacheName string
+
+	cacheEnabled bool
+}
+
+// New creates a Fetcher with its on-disk cache enabled by default.
+func New(client *http.Client, interrupt <-chan struct{}, cacheName string) *Fetcher {
+	return &Fetcher{
+		Client:       client,
+		Interrupt:    interrupt,
+		CacheName:    cacheName,
+		cacheEnabled: true,
+	}
+}
+
+// EnableCache turns this fetcher's on-disk response cache back on.
+func (f *Fetcher) EnableCache() {
+	f.cacheEnabled = true
+}
+
+// DisableCache turns off this fetcher's on-disk response cache. Existing
+// cache files on disk are left untouched.
+func (f *Fetcher) DisableCache() {
+	f.cacheEnabled = false
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns an exponentially increasing delay with jitter for the
+// given (zero-indexed) attempt number.
+func backoffDelay(attempt int) time.Duration {
+	d := baseBackoff * time.Duration(1<<uint(attempt))
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// retryAfterDelay honours a 429 response's Retry-After header, which may be
+// either delta-seconds or an HTTP-date, falling back to backoffDelay when
+// the header is absent or unparseable.
+func retryAfterDelay(h http.Header, attempt int) time.Duration {
+	ra := h.Get("Retry-After")
+	if ra == "" {
+		return backoffDelay(attempt)
+	}
+
+	if secs, err := strconv.Atoi(ra); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(ra); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return backoffDelay(attempt)
+}
+
+func (f *Fetcher) sleepOrInterrupted(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-f.Interrupt:
+		return errors.New("interrupted")
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// doRequestWithHeaders performs an HTTP GET against url with bounded retries
+// and exponential backoff + jitter on network errors and on 429/500/502/503/504
+// responses. 429 responses honour Retry-After. Any other status, including
+// 304 (used by the response cache), is returned to the caller without
+// consuming a retry.
+func (f *Fetcher) doRequestWithHeaders(ctx context.Context, url string, headers http.Header) (*http.Response, []byte, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, vs := range headers {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+
+		resp, err := f.Client.Do(req)
+		if err != nil {
+			lastErr = err
+			log.Warnln("Request failed, retrying: "+url, err)
+			if sErr := f.sleepOrInterrupted(ctx, backoffDelay(attempt)); sErr != nil {
+				return nil, nil, sErr
+			}
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			log.Warnln("Error reading response body, retrying: "+url, err)
+			if sErr := f.sleepOrInterrupted(ctx, backoffDelay(attempt)); sErr != nil {
+				return nil, nil, sErr
+			}
+			continue
+		}
+
+		if !isRetryableStatus(resp.StatusCode) {
+			return resp, body, nil
+		}
+
+		lastErr = fmt.Errorf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		log.Warnf("%s returned %d, retrying (attempt %d/%d)", url, resp.StatusCode, attempt+1, maxAttempts)
+		if sErr := f.sleepOrInterrupted(ctx, retryAfterDelay(resp.Header, attempt)); sErr != nil {
+			return nil, nil, sErr
+		}
+	}
+
+	return nil, nil, fmt.Errorf("giving up on %s after %d attempts: %w", url, maxAttempts, lastErr)
+}
+
+// DoRequest performs a retrying HTTP GET and returns the body of a plain 200
+// response. Any other status is returned as an error. It never consults or
+// populates the on-disk cache; use Get for cacheable metadata endpoints.
+func (f *Fetcher) DoRequest(ctx context.Context, url string) ([]byte, error) {
+	resp, body, err := f.doRequestWithHeaders(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return body, fmt.Errorf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return body, nil
+}
+
+// Size performs a HEAD request and returns the Content-Length reported for
+// url, or ok=false if the server didn't send one or the request failed.
+// It's used to decide whether a partially-downloaded file on disk is
+// already complete, so it deliberately doesn't retry like DoRequest does.
+func (f *Fetcher) Size(ctx context.Context, url string) (size int64, ok bool) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, false
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, false
+	}
+
+	return resp.ContentLength, true
+}
+
+// Per-response-kind TTLs are passed in by callers; this is just a sane
+// catch-all for anything that doesn't specify its own.
+const DefaultTTL = 5 * time.Minute
+
+type cacheEntry struct {
+	ETag     string    `json:"etag"`
+	CachedAt time.Time `json:"cachedAt"`
+	// MaxAge is the Cache-Control max-age in seconds, or -1 if the response
+	// didn't specify one and the caller's default TTL should be used.
+	MaxAge int    `json:"maxAge"`
+	Body   []byte `json:"body"`
+}
+
+func (e *cacheEntry) expired(defaultTTL time.Duration) bool {
+	ttl := defaultTTL
+	if e.MaxAge >= 0 {
+		ttl = time.Duration(e.MaxAge) * time.Second
+	}
+	return time.Since(e.CachedAt) > ttl
+}
+
+func (f *Fetcher) cacheDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(d, "manga-syncer", f.CacheName)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// cachePath returns the on-disk path for a cached response to url. Keys are
+// hashed since the path+query of these endpoints can be arbitrarily long.
+func (f *Fetcher) cachePath(url string) (string, error) {
+	dir, err := f.cacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json"), nil
+}
+
+func (f *Fetcher) readCacheEntry(url string) (*cacheEntry, string) {
+	path, err := f.cachePath(url)
+	if err != nil {
+		log.Debugln("Unable to determine cache path for "+url, err)
+		return nil, ""
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, path
+	}
+
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.Debugln("Discarding corrupt cache entry "+path, err)
+		return nil, path
+	}
+	return &e, path
+}
+
+func writeCacheEntry(path string, e *cacheEntry) {
+	if path == "" {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Warnln("Failed to marshal cache entry for "+path, err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		log.Warnln("Failed to write cache entry "+path, err)
+	}
+}
+
+// parseMaxAge reads max-age out of a Cache-Control header, returning -1 if
+// it's absent or the response must not be cached at all (no-store).
+func parseMaxAge(h http.Header) int {
+	cc := h.Get("Cache-Control")
+	if cc == "" {
+		return -1
+	}
+
+	for _, part := range strings.Split(cc, ",") {
+		part = strings.TrimSpace(part)
+		if part == "no-store" {
+			return -1
+		}
+		if strings.HasPrefix(part, "max-age=") {
+			secs, err := strconv.Atoi(strings.TrimPrefix(part, "max-age="))
+			if err == nil {
+				return secs
+			}
+		}
+	}
+
+	return -1
+}
+
+func cacheableResponse(h http.Header) bool {
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.TrimSpace(part) == "no-store" {
+			return false
+		}
+	}
+	return true
+}
+
+// Get fetches url, consulting and populating the on-disk response cache.
+// ttl is the fallback freshness window used when the server doesn't send
+// its own Cache-Control max-age. When preferCache is true, a cached
+// response is always used over making a request, regardless of its age, so
+// that callers can support offline re-runs (e.g. --print-valid).
+func (f *Fetcher) Get(ctx context.Context, url string, ttl time.Duration, preferCache bool) ([]byte, int, error) {
+	var cached *cacheEntry
+	var path string
+	if f.cacheEnabled {
+		cached, path = f.readCacheEntry(url)
+	}
+
+	if cached != nil && (preferCache || !cached.expired(ttl)) {
+		return cached.Body, http.StatusOK, nil
+	}
+
+	var headers http.Header
+	if cached != nil && cached.ETag != "" {
+		headers = http.Header{"If-None-Match": []string{cached.ETag}}
+	}
+
+	resp, body, err := f.doRequestWithHeaders(ctx, url, headers)
+	if err != nil {
+		if cached != nil {
+			log.Warnln("Request failed, falling back to stale cache for "+url, err)
+			return cached.Body, http.StatusOK, nil
+		}
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		cached.CachedAt = time.Now()
+		writeCacheEntry(path, cached)
+		return cached.Body, http.StatusOK, nil
+	}
+
+	if resp.StatusCode == http.StatusOK && f.cacheEnabled && cacheableResponse(resp.Header) {
+		path, err := f.cachePath(url)
+		if err == nil {
+			writeCacheEntry(path, &cacheEntry{
+				ETag:     resp.Header.Get("ETag"),
+				CachedAt: time.Now(),
+				MaxAge:   parseMaxAge(resp.Header),
+				Body:     body,
+			})
+		}
+	}
+
+	return body, resp.StatusCode, nil
+}
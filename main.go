@@ -18,6 +18,10 @@ import (
 
 	"github.com/awused/awconf"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/awused/manga-syncer/sources"
+	"github.com/awused/manga-syncer/sources/mangadex"
+	"github.com/awused/manga-syncer/sources/weebcentral"
 )
 
 type config struct {
@@ -29,6 +33,24 @@ type config struct {
 	RenameChapters     bool
 	AllowQuestionMarks bool
 	RenameManga        bool
+	BlockedGroups      []string
+	// Whether to write a ComicInfo.xml file into each downloaded archive.
+	// Defaults to true when unset.
+	WriteComicInfo *bool
+	// How many manga to sync concurrently. Each source enforces its own
+	// rate limits, so this just bounds parallelism. Defaults to 1 when unset.
+	MangaConcurrency int
+}
+
+func writeComicInfo() bool {
+	return conf.WriteComicInfo == nil || *conf.WriteComicInfo
+}
+
+func mangaConcurrency() int {
+	if conf.MangaConcurrency <= 0 {
+		return 1
+	}
+	return conf.MangaConcurrency
 }
 
 var conf config
@@ -41,8 +63,6 @@ var client *http.Client = &http.Client{
 	},
 }
 
-var delay = 2 * time.Second
-
 type stringable string
 
 var sem chan struct{}
@@ -92,19 +112,24 @@ func convertName(input string) string {
 	return strings.Trim(output, "- ")
 }
 
-func convertUUID(input string) (string, error) {
+// shortID shortens a source's ID for use in file and directory names. IDs
+// that are UUIDs (MangaDex) are base64-encoded down to their raw bytes;
+// anything else is just sanitized as-is.
+func shortID(input string) string {
 	u, err := uuid.Parse(input)
 	if err != nil {
-		log.Errorln("Invalid UUID string", input)
-		return "", err
+		return convertName(input)
 	}
 
-	return strings.Trim(base64.URLEncoding.EncodeToString(u[:]), "="), nil
+	return strings.Trim(base64.URLEncoding.EncodeToString(u[:]), "=")
 }
 
 var printValid = flag.Bool("print-valid", false, "Print all valid chapter archives to stdout without downloading anything new.")
 var printUmatched = flag.Bool("print-unmatched", false, "Print all chapter archives that exist in a manga directory but don't match a chapter on the remote host.")
-var chapterFlag = flag.String("chapter", "", "Download only this chapter from the given manga.")
+var chapterFlag = flag.String("chapter", "", "Download only this chapter from the given manga. MangaDex only.")
+var noCacheFlag = flag.Bool("no-cache", false, "Disable the on-disk response cache for metadata requests.")
+var progressFlag = flag.Bool("progress", false, "Force interactive progress bars even when stdout is not a terminal.")
+var noProgressFlag = flag.Bool("no-progress", false, "Disable interactive progress bars.")
 
 func main() {
 	flag.Parse()
@@ -126,9 +151,29 @@ func main() {
 		safeFilenameRegex = safeQuestionMarkRegex
 	}
 
-	// We can revisit this in the future but Mangadex in particular has a
-	// low limit so additional threads are dangerous.
-	// conf.Threads = 1
+	mdSource := mangadex.New(client, closeChan, conf.Language, conf.BlockedGroups)
+	sources.Register(mdSource)
+	sources.Register(weebcentral.New(client, closeChan))
+
+	if *noCacheFlag {
+		for _, s := range sources.All() {
+			if cc, ok := s.(sources.CacheControl); ok {
+				cc.DisableCache()
+			}
+		}
+	}
+
+	// --print-valid/--print-unmatched should be able to re-run entirely
+	// offline against the cache.
+	if *printValid || *printUmatched {
+		for _, s := range sources.All() {
+			if cp, ok := s.(sources.CachePreference); ok {
+				cp.SetPreferCache(true)
+			}
+		}
+	}
+
+	startProgress()
 
 	wg := sync.WaitGroup{}
 	sigs := make(chan os.Signal, 100)
@@ -136,44 +181,61 @@ func main() {
 	chapterChan := make(chan chapterJob, conf.Threads*2)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
 
-	// for i := 0; i < conf.Threads; i++ {
 	wg.Add(1)
 	go chapterWorker(chapterChan, &wg)
-	// }
 	sem = make(chan struct{}, conf.Threads)
 
 	manga := conf.Manga
 
 	if flag.NArg() > 0 {
-		mangaStrings := flag.Args()
-		manga = []string{}
-		for _, v := range mangaStrings {
-			m := v
-			manga = append(manga, m)
-		}
+		manga = append([]string{}, flag.Args()...)
 	}
 
 	if *chapterFlag != "" {
-		mid, err := getMangaIDForChapter(*chapterFlag)
+		mid, err := mdSource.MangaIDForChapter(*chapterFlag)
 		if err != nil {
 			log.Fatalln("Failed to get manga ID for chapter", *chapterFlag)
 		}
 		manga = []string{mid}
-		delay = 0 // We will be making very few calls, so disable any delays
+	}
+
+	// Manga are synced concurrently, bounded by MangaConcurrency. Each
+	// source's own transport enforces that source's rate limits, so this
+	// only needs to bound how much work happens at once.
+	mangaQueue := make(chan string, len(manga))
+	for _, raw := range manga {
+		mangaQueue <- raw
+	}
+	close(mangaQueue)
+
+	mangaWg := sync.WaitGroup{}
+	for i := 0; i < mangaConcurrency(); i++ {
+		mangaWg.Add(1)
+		go func() {
+			defer mangaWg.Done()
+			for raw := range mangaQueue {
+				select {
+				case <-closeChan:
+					return
+				default:
+				}
+
+				src, id, err := sources.Identify(raw)
+				if err != nil {
+					log.Errorln(err)
+					continue
+				}
+
+				syncManga(src, id, chapterChan)
+			}
+		}()
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer close(chapterChan)
-		for _, m := range manga {
-			select {
-			case <-closeChan:
-				return
-			case <-time.After(delay):
-			}
-			syncManga(m, chapterChan)
-		}
+		mangaWg.Wait()
 	}()
 
 	go func() {
@@ -189,4 +251,5 @@ func main() {
 	}
 
 	wg.Wait()
+	stopProgress()
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// progressContainer renders interactive progress bars to stderr. It stays
+// nil whenever progress bars are disabled; every other function in this file
+// treats a nil container/bar as a no-op.
+var progressContainer *mpb.Progress
+
+// overallBar tracks chapters completed against chapters queued so far,
+// across every manga being synced this run. Its total grows as chapters are
+// discovered rather than being known up front.
+var overallBar *mpb.Bar
+var overallTotal int64
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressWanted decides whether interactive progress bars should be used,
+// honouring --progress/--no-progress and otherwise falling back to
+// auto-detection. Progress bars would only get in the way of the plain
+// stdout output of --print-valid/--print-unmatched/-chapter, so those
+// disable it regardless of the terminal.
+func progressWanted() bool {
+	if *noProgressFlag {
+		return false
+	}
+	if *progressFlag {
+		return true
+	}
+	if *printValid || *printUmatched || *chapterFlag != "" {
+		return false
+	}
+	return isTerminal(os.Stderr)
+}
+
+// startProgress sets up the progress container and the overall chapters
+// bar, and routes logrus output through the container so log lines are
+// printed above the bars instead of shredding them. It's a no-op if
+// progress bars aren't wanted.
+func startProgress() {
+	if !progressWanted() {
+		return
+	}
+
+	progressContainer = mpb.New(mpb.WithOutput(os.Stderr), mpb.WithWidth(60))
+	log.SetOutput(progressContainer)
+
+	overallBar = progressContainer.AddBar(0,
+		mpb.PrependDecorators(decor.Name("Overall")),
+		mpb.AppendDecorators(decor.CountersNoUnit("%d / %d chapters")),
+	)
+}
+
+// stopProgress waits for the progress bars to finish rendering and restores
+// logrus' output. It's a no-op if progress bars weren't started.
+func stopProgress() {
+	if progressContainer == nil {
+		return
+	}
+	progressContainer.Wait()
+	log.SetOutput(os.Stderr)
+}
+
+// queueChapterForProgress grows the overall bar's total by one for a
+// chapter that's just been queued for download.
+func queueChapterForProgress() {
+	if overallBar == nil {
+		return
+	}
+	overallBar.SetTotal(atomic.AddInt64(&overallTotal, 1), false)
+}
+
+// completeChapterForProgress marks one chapter as finished on the overall
+// bar, whether or not its download actually succeeded.
+func completeChapterForProgress() {
+	if overallBar == nil {
+		return
+	}
+	overallBar.Increment()
+}
+
+// byteRate tracks bytes transferred since it was created to report a
+// running bytes/sec readout on a progress bar.
+type byteRate struct {
+	start time.Time
+	bytes int64
+}
+
+func newByteRate() *byteRate {
+	return &byteRate{start: time.Now()}
+}
+
+func (r *byteRate) add(n int) {
+	atomic.AddInt64(&r.bytes, int64(n))
+}
+
+func (r *byteRate) String() string {
+	elapsed := time.Since(r.start).Seconds()
+	if elapsed <= 0 {
+		return "0 B/s"
+	}
+	return formatByteRate(float64(atomic.LoadInt64(&r.bytes)) / elapsed)
+}
+
+func formatByteRate(bps float64) string {
+	const unit = 1024.0
+	if bps < unit {
+		return fmt.Sprintf("%.0f B/s", bps)
+	}
+
+	div, exp := unit, 0
+	for n := bps / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB/s", bps/div, "KMGTPE"[exp])
+}
+
+// newChapterBar creates a progress bar tracking pages downloaded against
+// total pages for a single chapter, plus a live bytes/sec readout. It
+// returns nil, nil if progress bars are disabled.
+func newChapterBar(name string, totalPages int) (*mpb.Bar, *byteRate) {
+	if progressContainer == nil {
+		return nil, nil
+	}
+
+	rate := newByteRate()
+	bar := progressContainer.AddBar(int64(totalPages),
+		mpb.PrependDecorators(decor.Name(name, decor.WCSyncSpaceR)),
+		mpb.AppendDecorators(
+			decor.CountersNoUnit("%d / %d pages"),
+			decor.Any(func(decor.Statistics) string { return rate.String() }, decor.WCSyncSpace),
+		),
+	)
+	return bar, rate
+}
@@ -0,0 +1,603 @@
+// Package mangadex implements sources.Source against the MangaDex API.
+package mangadex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/awused/manga-syncer/httputil"
+	"github.com/awused/manga-syncer/sources"
+)
+
+const (
+	mangaURL            = "https://api.mangadex.org/manga/%s"
+	chapterURL          = "https://api.mangadex.org/chapter/%s"
+	scanlationGroupsURL = "https://api.mangadex.org/group?limit=100"
+	chaptersURL         = "https://api.mangadex.org/manga/%s/feed?limit=%d&offset=%d&translatedLanguage[]=%s&order[volume]=asc&order[chapter]=asc"
+	atHomeServerURL     = "https://api.mangadex.org/at-home/server/%s"
+
+	pageSize = 100
+
+	mangaCacheTTL   = 12 * time.Hour
+	feedCacheTTL    = 5 * time.Minute
+	groupsCacheTTL  = 7 * 24 * time.Hour
+	chapterCacheTTL = 5 * time.Minute
+)
+
+// Source implements sources.Source against the MangaDex API. Its client's
+// transport rate limits every request per MangaDex's documented limits, so
+// the Source itself needs no throttling of its own and is safe to drive
+// concurrently for many manga at once.
+type Source struct {
+	fetcher       *httputil.Fetcher
+	language      string
+	blockedGroups []string
+
+	// preferCache implements sources.CachePreference: when set, a cached
+	// response is used regardless of its age, so --print-valid/--print-unmatched
+	// can re-run entirely offline.
+	preferCache int32
+
+	// rawByID retains each chapter's raw MangaDex attributes (hash, page
+	// list) between ListChapters and the later FetchChapterPages call for
+	// that chapter, since the generic sources.Chapter doesn't carry them.
+	rawByID struct {
+		mu sync.Mutex
+		m  map[string]mangaChapter
+	}
+}
+
+// New creates a MangaDex source. client and interrupt may be nil; a nil
+// client gets a sensible default. Either way, the client's transport is
+// wrapped to enforce MangaDex's rate limits.
+func New(client *http.Client, interrupt <-chan struct{}, language string, blockedGroups []string) *Source {
+	if client == nil {
+		client = &http.Client{}
+	}
+	limited := *client
+	limited.Transport = newRateLimitedTransport(client.Transport)
+
+	return &Source{
+		fetcher:       httputil.New(&limited, interrupt, "mangadex"),
+		language:      language,
+		blockedGroups: blockedGroups,
+	}
+}
+
+func (s *Source) Name() string { return "mangadex" }
+
+func (s *Source) EnableCache()  { s.fetcher.EnableCache() }
+func (s *Source) DisableCache() { s.fetcher.DisableCache() }
+
+// SetPreferCache implements sources.CachePreference.
+func (s *Source) SetPreferCache(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&s.preferCache, i)
+}
+
+func (s *Source) wantsCache() bool {
+	return atomic.LoadInt32(&s.preferCache) != 0
+}
+
+func uuidLike(id string) bool {
+	return len(id) == 36 && strings.Count(id, "-") == 4
+}
+
+// Identify recognizes mangadex.org manga URLs, as well as bare MangaDex
+// manga UUIDs for backwards compatibility with older configs.
+func (s *Source) Identify(rawURL string) (string, bool) {
+	if uuidLike(rawURL) {
+		return rawURL, true
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	host := strings.TrimPrefix(u.Host, "www.")
+	if host != "mangadex.org" {
+		return "", false
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, p := range parts {
+		if (p == "title" || p == "manga") && i+1 < len(parts) {
+			return parts[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+type stringable string
+
+func (st *stringable) UnmarshalJSON(b []byte) error {
+	if b[0] != '"' {
+		var i int
+		err := json.Unmarshal(b, &i)
+		*st = (stringable)(fmt.Sprint(i))
+		return err
+	}
+	return json.Unmarshal(b, (*string)(st))
+}
+
+type mangaChapter struct {
+	Result string `json:"result"`
+	Data   struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Volume             *stringable `json:"volume"`
+			Chapter            stringable  `json:"chapter"`
+			Title              *string     `json:"title"`
+			TranslatedLanguage string      `json:"translatedLanguage"`
+			Hash               string      `json:"hash"`
+			Data               []string    `json:"data"`
+			DataSaver          []string    `json:"dataSaver"`
+			PublishAt          time.Time   `json:"publishAt"`
+			CreatedAt          time.Time   `json:"createdAt"`
+			UpdatedAt          interface{} `json:"updatedAt"`
+			Version            int         `json:"version"`
+		} `json:"attributes"`
+	} `json:"data"`
+	Relationships []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"relationships"`
+}
+
+type chaptersResponse struct {
+	Results []mangaChapter `json:"results"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	Total   int            `json:"total"`
+}
+
+type mangaMetadata struct {
+	Result string `json:"result"`
+	Data   struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Title     map[string]string `json:"title"`
+			AltTitles []struct {
+				En string `json:"en"`
+			} `json:"altTitles"`
+			Description struct {
+				En string `json:"en"`
+			} `json:"description"`
+			IsLocked bool `json:"isLocked"`
+			Links    struct {
+				Al    string `json:"al"`
+				Ap    string `json:"ap"`
+				Bw    string `json:"bw"`
+				Kt    string `json:"kt"`
+				Mu    string `json:"mu"`
+				Amz   string `json:"amz"`
+				Ebj   string `json:"ebj"`
+				Mal   string `json:"mal"`
+				Raw   string `json:"raw"`
+				Engtl string `json:"engtl"`
+			} `json:"links"`
+			OriginalLanguage       string      `json:"originalLanguage"`
+			LastVolume             interface{} `json:"lastVolume"`
+			LastChapter            string      `json:"lastChapter"`
+			PublicationDemographic string      `json:"publicationDemographic"`
+			Status                 string      `json:"status"`
+			Year                   interface{} `json:"year"`
+			ContentRating          string      `json:"contentRating"`
+			Tags                   []struct {
+				ID         string `json:"id"`
+				Type       string `json:"type"`
+				Attributes struct {
+					Name struct {
+						En string `json:"en"`
+					} `json:"name"`
+					Version int `json:"version"`
+				} `json:"attributes"`
+			} `json:"tags"`
+			CreatedAt time.Time   `json:"createdAt"`
+			UpdatedAt interface{} `json:"updatedAt"`
+			Version   int         `json:"version"`
+		} `json:"attributes"`
+	} `json:"data"`
+	Relationships []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"relationships"`
+}
+
+type scanlationGroups struct {
+	Results []struct {
+		Data struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				Name string `json:"name"`
+			} `json:"attributes"`
+		} `json:"data"`
+	} `json:"results"`
+}
+
+type atHomeResponse struct {
+	BaseURL string `json:"baseUrl"`
+}
+
+func mangaTitle(m mangaMetadata) string {
+	title, ok := m.Data.Attributes.Title["en"]
+	if !ok {
+		for _, v := range m.Data.Attributes.Title {
+			title = v
+			break
+		}
+	}
+	return title
+}
+
+func (s *Source) get(url string, ttl time.Duration) ([]byte, int, error) {
+	return s.fetcher.Get(context.Background(), url, ttl, s.wantsCache())
+}
+
+func (s *Source) FetchManga(id string) (sources.Manga, error) {
+	u := fmt.Sprintf(mangaURL, id)
+
+	body, status, err := s.get(u, mangaCacheTTL)
+	if err != nil {
+		return sources.Manga{}, err
+	}
+	if status != http.StatusOK {
+		return sources.Manga{}, fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+
+	var m mangaMetadata
+	if err := json.Unmarshal(body, &m); err != nil {
+		return sources.Manga{}, err
+	}
+	if m.Result != "ok" {
+		return sources.Manga{}, errors.New(m.Result)
+	}
+
+	tags := make([]string, 0, len(m.Data.Attributes.Tags))
+	for _, t := range m.Data.Attributes.Tags {
+		tags = append(tags, t.Attributes.Name.En)
+	}
+
+	year, _ := m.Data.Attributes.Year.(float64)
+
+	return sources.Manga{
+		ID:                     m.Data.ID,
+		Title:                  mangaTitle(m),
+		OriginalLanguage:       m.Data.Attributes.OriginalLanguage,
+		PublicationDemographic: m.Data.Attributes.PublicationDemographic,
+		ContentRating:          m.Data.Attributes.ContentRating,
+		Tags:                   tags,
+		Year:                   int(year),
+	}, nil
+}
+
+func groupIDsForChapter(c mangaChapter) []string {
+	ids := []string{}
+	for _, r := range c.Relationships {
+		if r.Type == "scanlation_group" {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+func (s *Source) blocked(c mangaChapter) bool {
+	for _, g := range groupIDsForChapter(c) {
+		for _, bg := range s.blockedGroups {
+			if g == bg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Source) getChapterPage(mid string, offset int) (chaptersResponse, error) {
+	u := fmt.Sprintf(chaptersURL, mid, pageSize, offset, s.language)
+
+	body, status, err := s.get(u, feedCacheTTL)
+	if err != nil {
+		return chaptersResponse{}, err
+	}
+	if status != http.StatusOK {
+		return chaptersResponse{}, fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+
+	var cr chaptersResponse
+	err = json.Unmarshal(body, &cr)
+	return cr, err
+}
+
+func (s *Source) getAllChapters(mid string) ([]mangaChapter, error) {
+	total := 1
+	offset := 0
+	chapters := []mangaChapter{}
+
+	for offset < total {
+		cr, err := s.getChapterPage(mid, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		chapters = append(chapters, cr.Results...)
+		total = cr.Total
+
+		if len(cr.Results) != pageSize && offset+len(cr.Results) < total {
+			log.Warningf("Manga %s: invalid chapter pagination. "+
+				"Requested %d chapters at offset %d with %d total but got %d\n",
+				mid, pageSize, offset, total, len(cr.Results))
+		}
+
+		offset += pageSize
+	}
+
+	return chapters, nil
+}
+
+func (s *Source) getAllGroups(chapters []mangaChapter) (map[string]string, error) {
+	groups := make(map[string]string)
+	for _, c := range chapters {
+		for _, g := range groupIDsForChapter(c) {
+			groups[g] = ""
+		}
+	}
+	if len(groups) == 0 {
+		return groups, nil
+	}
+
+	u := scanlationGroupsURL
+	for gid := range groups {
+		u += "&ids[]=" + gid
+	}
+
+	body, status, err := s.get(u, groupsCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+
+	var sg scanlationGroups
+	if err := json.Unmarshal(body, &sg); err != nil {
+		return nil, err
+	}
+
+	groups = make(map[string]string)
+	for _, g := range sg.Results {
+		groups[g.Data.ID] = g.Data.Attributes.Name
+	}
+	return groups, nil
+}
+
+func groupNamesForChapter(c mangaChapter, groups map[string]string) []string {
+	gns := []string{}
+	for _, g := range groupIDsForChapter(c) {
+		if gn, ok := groups[g]; ok {
+			gns = append(gns, gn)
+		}
+	}
+	return gns
+}
+
+func toChapter(c mangaChapter, groups map[string]string) sources.Chapter {
+	volume := ""
+	if c.Data.Attributes.Volume != nil {
+		volume = string(*c.Data.Attributes.Volume)
+	}
+
+	title := ""
+	if c.Data.Attributes.Title != nil {
+		title = *c.Data.Attributes.Title
+	}
+
+	return sources.Chapter{
+		ID:          c.Data.ID,
+		Volume:      volume,
+		Number:      string(c.Data.Attributes.Chapter),
+		Title:       title,
+		Language:    c.Data.Attributes.TranslatedLanguage,
+		GroupNames:  groupNamesForChapter(c, groups),
+		PublishedAt: c.Data.Attributes.PublishAt,
+		URL:         "https://mangadex.org/chapter/" + c.Data.ID,
+	}
+}
+
+// ListChapters fetches every chapter for mangaID in the configured
+// language, filtering out blocked scanlation groups and chapters with no
+// downloadable pages.
+func (s *Source) ListChapters(mangaID string) ([]sources.Chapter, error) {
+	raw, err := s.getAllChapters(mangaID)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]mangaChapter, 0, len(raw))
+	seen := make(map[string]bool)
+	for _, c := range raw {
+		if s.blocked(c) {
+			continue
+		}
+		if seen[c.Data.ID] {
+			log.Warningln("duplicate chapter ID " + c.Data.ID)
+			continue
+		}
+		seen[c.Data.ID] = true
+
+		if len(c.Data.Attributes.Data) == 0 {
+			continue
+		}
+		if len(c.Data.Attributes.Data) == 1 &&
+			strings.HasPrefix(c.Data.Attributes.Data[0], "https://") {
+			continue
+		}
+
+		filtered = append(filtered, c)
+	}
+
+	groups, err := s.getAllGroups(filtered)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rawByID.mu.Lock()
+	if s.rawByID.m == nil {
+		s.rawByID.m = make(map[string]mangaChapter)
+	}
+	for _, c := range filtered {
+		s.rawByID.m[c.Data.ID] = c
+	}
+	s.rawByID.mu.Unlock()
+
+	out := make([]sources.Chapter, 0, len(filtered))
+	for _, c := range filtered {
+		out = append(out, toChapter(c, groups))
+	}
+	return out, nil
+}
+
+// FetchChapterPages looks up the chapter's at-home server and builds the
+// full page URLs for it.
+func (s *Source) FetchChapterPages(c sources.Chapter) ([]sources.Page, error) {
+	s.rawByID.mu.Lock()
+	raw, ok := s.rawByID.m[c.ID]
+	s.rawByID.mu.Unlock()
+	if !ok {
+		// -chapter bypasses ListChapters, so fetch it directly.
+		var err error
+		raw, err = s.getSingleChapter(c.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u := fmt.Sprintf(atHomeServerURL, c.ID)
+	body, err := s.fetcher.DoRequest(context.Background(), u)
+	if err != nil {
+		return nil, err
+	}
+
+	var ah atHomeResponse
+	if err := json.Unmarshal(body, &ah); err != nil {
+		return nil, err
+	}
+	if ah.BaseURL == "" {
+		return nil, errors.New("empty at-home base URL")
+	}
+
+	pages := make([]sources.Page, 0, len(raw.Data.Attributes.Data))
+	for _, p := range raw.Data.Attributes.Data {
+		pages = append(pages, sources.Page{
+			URL: ah.BaseURL + "/data/" + raw.Data.Attributes.Hash + "/" + p,
+		})
+	}
+	return pages, nil
+}
+
+// ResumeKey implements sources.ResumeKeyer. MangaDex's at-home endpoint can
+// hand back a different CDN BaseURL on every call even when the chapter's
+// Hash and page list are unchanged, so the rendered page URLs aren't a
+// stable basis for resuming a partial download. The Hash plus the ordered
+// page filenames are.
+func (s *Source) ResumeKey(c sources.Chapter) (string, error) {
+	s.rawByID.mu.Lock()
+	raw, ok := s.rawByID.m[c.ID]
+	s.rawByID.mu.Unlock()
+	if !ok {
+		var err error
+		raw, err = s.getSingleChapter(c.ID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return raw.Data.Attributes.Hash + "\n" + strings.Join(raw.Data.Attributes.Data, "\n"), nil
+}
+
+func (s *Source) FetchBytes(url string) ([]byte, error) {
+	return s.fetcher.DoRequest(context.Background(), url)
+}
+
+func (s *Source) FetchSize(url string) (int64, bool) {
+	return s.fetcher.Size(context.Background(), url)
+}
+
+func (s *Source) getSingleChapter(cid string) (mangaChapter, error) {
+	var c mangaChapter
+	u := fmt.Sprintf(chapterURL, cid)
+
+	body, status, err := s.get(u, chapterCacheTTL)
+	if err != nil {
+		return c, err
+	}
+	if status != http.StatusOK {
+		return c, fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+
+	err = json.Unmarshal(body, &c)
+	return c, err
+}
+
+// FetchChapter looks up a single chapter by ID, independent of
+// ListChapters, resolving its scanlation group names along the way.
+func (s *Source) FetchChapter(id string) (sources.Chapter, error) {
+	c, err := s.getSingleChapter(id)
+	if err != nil {
+		return sources.Chapter{}, err
+	}
+
+	groups, err := s.getAllGroups([]mangaChapter{c})
+	if err != nil {
+		return sources.Chapter{}, err
+	}
+
+	s.rawByID.mu.Lock()
+	if s.rawByID.m == nil {
+		s.rawByID.m = make(map[string]mangaChapter)
+	}
+	s.rawByID.m[c.Data.ID] = c
+	s.rawByID.mu.Unlock()
+
+	return toChapter(c, groups), nil
+}
+
+// MangaIDForChapter implements sources.ChapterLookup, backing the -chapter
+// flag: given a bare chapter ID, find the manga it belongs to.
+func (s *Source) MangaIDForChapter(chapterID string) (string, error) {
+	c, err := s.getSingleChapter(chapterID)
+	if err != nil {
+		return "", err
+	}
+
+	s.rawByID.mu.Lock()
+	if s.rawByID.m == nil {
+		s.rawByID.m = make(map[string]mangaChapter)
+	}
+	s.rawByID.m[c.Data.ID] = c
+	s.rawByID.mu.Unlock()
+
+	for _, v := range c.Relationships {
+		if v.Type == "manga" {
+			return v.ID, nil
+		}
+	}
+
+	return "", errors.New("no manga ID for chapter " + chapterID)
+}
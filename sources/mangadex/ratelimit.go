@@ -0,0 +1,59 @@
+package mangadex
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedTransport enforces MangaDex's documented global rate limits
+// (https://api.mangadex.org/docs/2-limitations/) by consulting a
+// per-endpoint-group token bucket before every outgoing request, so every
+// code path going through this Source's client - metadata, feed, groups,
+// at-home lookups - is automatically compliant regardless of how many
+// manga are being synced concurrently. Image CDN requests aren't subject
+// to a documented limit and pass straight through.
+type rateLimitedTransport struct {
+	base http.RoundTripper
+
+	// general covers the bulk of api.mangadex.org, documented at 5 req/s.
+	general *rate.Limiter
+	// atHome covers /at-home/server lookups, documented at 40 req/min.
+	atHome *rate.Limiter
+}
+
+func newRateLimitedTransport(base http.RoundTripper) *rateLimitedTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitedTransport{
+		base:    base,
+		general: rate.NewLimiter(rate.Limit(5), 5),
+		atHome:  rate.NewLimiter(rate.Every(time.Minute/40), 1),
+	}
+}
+
+func (t *rateLimitedTransport) limiterFor(req *http.Request) *rate.Limiter {
+	if req.URL.Host != "api.mangadex.org" {
+		// Image CDN hosts (e.g. uploads.mangadex.org) aren't rate limited.
+		return nil
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/at-home/") {
+		return t.atHome
+	}
+
+	return t.general
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if l := t.limiterFor(req); l != nil {
+		if err := l.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
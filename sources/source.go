@@ -0,0 +1,127 @@
+// Package sources defines the provider-agnostic types that manga-syncer
+// syncs against, and a small registry so that a config entry (a manga URL)
+// can be dispatched to whichever Source understands its host.
+package sources
+
+import (
+	"fmt"
+	"time"
+)
+
+// Manga is the provider-agnostic metadata manga-syncer needs about a series
+// in order to name its directory and populate ComicInfo.xml.
+type Manga struct {
+	// ID is the source's own identifier for this manga, e.g. a MangaDex UUID.
+	ID                     string
+	Title                  string
+	OriginalLanguage       string
+	PublicationDemographic string
+	ContentRating          string
+	Tags                   []string
+	Year                   int
+}
+
+// Chapter is the provider-agnostic metadata manga-syncer needs about a
+// single chapter in order to name its archive and populate ComicInfo.xml.
+type Chapter struct {
+	// ID is the source's own identifier for this chapter.
+	ID          string
+	MangaID     string
+	Volume      string // Empty if the chapter has no volume.
+	Number      string
+	Title       string
+	Language    string
+	GroupNames  []string
+	PublishedAt time.Time
+	// URL is the canonical web page for this chapter, if the source has one.
+	URL string
+}
+
+// Page is a single downloadable page of a chapter.
+type Page struct {
+	URL string
+}
+
+// Source is implemented by each manga provider manga-syncer knows how to
+// sync from. A Source owns its own HTTP fetching, caching and rate
+// limiting so that different providers never contend with each other.
+type Source interface {
+	// Name identifies this source for logging and for namespacing its cache.
+	Name() string
+
+	// Identify reports whether rawURL belongs to this source, and if so,
+	// extracts this source's own ID for the manga it points to.
+	Identify(rawURL string) (id string, ok bool)
+
+	FetchManga(id string) (Manga, error)
+	ListChapters(mangaID string) ([]Chapter, error)
+	// FetchChapter looks up a single chapter by ID, independent of
+	// ListChapters. It backs the -chapter flag.
+	FetchChapter(id string) (Chapter, error)
+	FetchChapterPages(c Chapter) ([]Page, error)
+
+	// FetchBytes downloads a single page's raw bytes through this source's
+	// own fetcher, honouring its retries and rate limits.
+	FetchBytes(url string) ([]byte, error)
+
+	// FetchSize reports the size in bytes url would download as, without
+	// downloading it, so that a resumed download can skip pages it already
+	// has on disk. ok is false if the source couldn't determine a size.
+	FetchSize(url string) (size int64, ok bool)
+}
+
+// ChapterLookup is an optional capability for sources that can resolve a
+// bare chapter ID to its parent manga ID, without already knowing the
+// manga. It backs the -chapter flag.
+type ChapterLookup interface {
+	MangaIDForChapter(chapterID string) (string, error)
+}
+
+// CacheControl is an optional capability for sources backed by an on-disk
+// response cache, letting callers toggle it at runtime (e.g. --no-cache).
+type CacheControl interface {
+	EnableCache()
+	DisableCache()
+}
+
+// CachePreference is an optional capability for sources backed by an
+// on-disk response cache, letting callers prefer a cached response over
+// making a request regardless of its age (e.g. --print-valid/--print-unmatched
+// re-running offline).
+type CachePreference interface {
+	SetPreferCache(bool)
+}
+
+// ResumeKeyer is an optional capability for sources whose FetchChapterPages
+// URLs aren't stable across calls even when the underlying pages are
+// unchanged (e.g. MangaDex's at-home endpoint handing back a different CDN
+// mirror on every call). When implemented, callers should key a resumable
+// download on ResumeKey's result instead of the pages' raw URLs.
+type ResumeKeyer interface {
+	ResumeKey(c Chapter) (string, error)
+}
+
+var registry []Source
+
+// Register adds s to the set of sources consulted by Identify. It's meant
+// to be called from each source package's init().
+func Register(s Source) {
+	registry = append(registry, s)
+}
+
+// All returns every source registered so far, so callers can apply global
+// settings (cache toggles, preferences) across all of them.
+func All() []Source {
+	return append([]Source{}, registry...)
+}
+
+// Identify finds the registered Source that understands rawURL, along with
+// that source's own ID for the manga it points to.
+func Identify(rawURL string) (Source, string, error) {
+	for _, s := range registry {
+		if id, ok := s.Identify(rawURL); ok {
+			return s, id, nil
+		}
+	}
+	return nil, "", fmt.Errorf("no source recognizes %q", rawURL)
+}
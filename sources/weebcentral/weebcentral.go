@@ -0,0 +1,186 @@
+// Package weebcentral implements sources.Source against weebcentral.com, a
+// plain HTML manga reader with no JSON API. It's intentionally minimal:
+// enough regex-based scraping to prove the Source abstraction works for a
+// non-MangaDex host, not a full HTML parser.
+package weebcentral
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awused/manga-syncer/httputil"
+	"github.com/awused/manga-syncer/sources"
+)
+
+const (
+	seriesURLFmt  = "https://weebcentral.com/series/%s"
+	chapterURLFmt = "https://weebcentral.com/chapters/%s"
+
+	callInterval = 2 * time.Second
+)
+
+// Source implements sources.Source against weebcentral.com.
+type Source struct {
+	fetcher *httputil.Fetcher
+
+	mu       sync.Mutex
+	lastCall time.Time
+
+	// preferCache implements sources.CachePreference: when set, a cached
+	// response is used regardless of its age, so --print-valid/--print-unmatched
+	// can re-run entirely offline.
+	preferCache int32
+}
+
+// New creates a weebcentral source. client and interrupt may be nil; a nil
+// client gets a sensible default.
+func New(client *http.Client, interrupt <-chan struct{}) *Source {
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{IdleConnTimeout: 30 * time.Second},
+		}
+	}
+	return &Source{fetcher: httputil.New(client, interrupt, "weebcentral")}
+}
+
+func (s *Source) Name() string { return "weebcentral" }
+
+func (s *Source) EnableCache()  { s.fetcher.EnableCache() }
+func (s *Source) DisableCache() { s.fetcher.DisableCache() }
+
+// SetPreferCache implements sources.CachePreference.
+func (s *Source) SetPreferCache(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&s.preferCache, i)
+}
+
+func (s *Source) wantsCache() bool {
+	return atomic.LoadInt32(&s.preferCache) != 0
+}
+
+// Identify recognizes weebcentral.com/series/<id> URLs, including the
+// trailing title slug (/series/<id>/<title-slug>) that users actually copy
+// out of their browser.
+func (s *Source) Identify(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	host := strings.TrimPrefix(u.Host, "www.")
+	if host != "weebcentral.com" {
+		return "", false
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, p := range parts {
+		if p == "series" && i+1 < len(parts) {
+			return parts[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+func (s *Source) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := callInterval - time.Since(s.lastCall); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.lastCall = time.Now()
+}
+
+func (s *Source) getPage(url string) (string, error) {
+	s.wait()
+	body, status, err := s.fetcher.Get(context.Background(), url, httputil.DefaultTTL, s.wantsCache())
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+	return string(body), nil
+}
+
+var titleRe = regexp.MustCompile(`<h1[^>]*>([^<]+)</h1>`)
+
+func (s *Source) FetchManga(id string) (sources.Manga, error) {
+	page, err := s.getPage(fmt.Sprintf(seriesURLFmt, id))
+	if err != nil {
+		return sources.Manga{}, err
+	}
+
+	title := id
+	if m := titleRe.FindStringSubmatch(page); m != nil {
+		title = strings.TrimSpace(m[1])
+	}
+
+	return sources.Manga{ID: id, Title: title}, nil
+}
+
+var chapterLinkRe = regexp.MustCompile(`/chapters/([a-zA-Z0-9_-]+)"[^>]*>\s*Chapter\s+([0-9.]+)`)
+
+// ListChapters scrapes the series page for links to individual chapters.
+// weebcentral doesn't expose scanlation group metadata in a scrapeable
+// form, so GroupNames is always empty.
+func (s *Source) ListChapters(mangaID string) ([]sources.Chapter, error) {
+	page, err := s.getPage(fmt.Sprintf(seriesURLFmt, mangaID))
+	if err != nil {
+		return nil, err
+	}
+
+	matches := chapterLinkRe.FindAllStringSubmatch(page, -1)
+	chapters := make([]sources.Chapter, 0, len(matches))
+	for _, m := range matches {
+		chapters = append(chapters, sources.Chapter{
+			ID:      m[1],
+			MangaID: mangaID,
+			Number:  m[2],
+			URL:     fmt.Sprintf(chapterURLFmt, m[1]),
+		})
+	}
+	return chapters, nil
+}
+
+// FetchChapter isn't meaningfully supported since weebcentral's chapter
+// pages carry no chapter-number metadata outside of the series page's
+// listing; callers should prefer ListChapters.
+func (s *Source) FetchChapter(id string) (sources.Chapter, error) {
+	return sources.Chapter{ID: id, URL: fmt.Sprintf(chapterURLFmt, id)}, nil
+}
+
+var imageRe = regexp.MustCompile(`<img[^>]+src="([^"]+)"[^>]*class="[^"]*chapter-image`)
+
+func (s *Source) FetchChapterPages(c sources.Chapter) ([]sources.Page, error) {
+	page, err := s.getPage(fmt.Sprintf(chapterURLFmt, c.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	matches := imageRe.FindAllStringSubmatch(page, -1)
+	pages := make([]sources.Page, 0, len(matches))
+	for _, m := range matches {
+		pages = append(pages, sources.Page{URL: m[1]})
+	}
+	return pages, nil
+}
+
+func (s *Source) FetchBytes(url string) ([]byte, error) {
+	s.wait()
+	return s.fetcher.DoRequest(context.Background(), url)
+}
+
+func (s *Source) FetchSize(url string) (int64, bool) {
+	return s.fetcher.Size(context.Background(), url)
+}